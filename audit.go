@@ -0,0 +1,40 @@
+package oauth
+
+import "time"
+
+// AuditEvent records a single security-relevant event from the OAuth flow,
+// so applications can persist a record of logins, failures, and sign-outs
+// to their own logging or SIEM pipeline instead of relying on Handler.Log,
+// which is meant for debugging rather than forensic review.
+type AuditEvent struct {
+	// Type is one of "login_started", "login_succeeded", "login_failed",
+	// "logoff", "cookie_invalid", "acl_denied", "account_linked", or
+	// "account_unlinked".
+	Type string
+
+	RemoteAddr string
+	UserAgent  string
+
+	// ProfileID is set when the event concerns a known user: always for
+	// login_succeeded, acl_denied, account_linked, and account_unlinked;
+	// for logoff when the cookie still identifies the user; and for a
+	// login_failed that happens after the provider identified the user.
+	// Empty otherwise.
+	ProfileID string
+
+	// Reason explains a login_failed, cookie_invalid, or acl_denied
+	// event, e.g. "rate limited" or the underlying error. For
+	// account_linked and account_unlinked it holds the external ID that
+	// was linked to or unlinked from ProfileID. Empty for events that
+	// aren't a failure.
+	Reason string
+
+	Time time.Time
+}
+
+// AuditLogger receives AuditEvents as Handler and MultiHandler emit them.
+// Applications implement this to persist events to their own logging
+// pipeline. A Handler with no AuditLogger discards all events.
+type AuditLogger interface {
+	Audit(AuditEvent)
+}
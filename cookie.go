@@ -22,8 +22,47 @@ func (h *Handler) cookieName() string {
 	return h.CookieName
 }
 
-func (h *Handler) setCookie(w http.ResponseWriter, in []byte) {
-	dcheck := append([]byte(h.Domain), byte(' ')) // delimiter
+func (h *Handler) SetCookie(w http.ResponseWriter, in []byte) {
+	setCookie(w, h.CookieKeys, h.Domain, h.cookieName(), in)
+}
+
+// Cookie returns the authenticated Profile ID for r: the raw cookie payload
+// when no SessionStore is configured, or the ProfileID of the session it
+// names otherwise.
+//
+// If the cookie decrypted against an old entry in CookieKeys rather than
+// CookieKeys[0], Cookie re-issues it on w encrypted with the current key,
+// so the rotation is transparent to callers and the old key can eventually
+// be retired.
+func (h *Handler) Cookie(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	b, keyIndex, err := cookie(r, h.CookieKeys, h.Domain, h.cookieName())
+	if err != nil {
+		return nil, err
+	}
+	if keyIndex > 0 {
+		setCookie(w, h.CookieKeys, h.Domain, h.cookieName(), b)
+	}
+	if h.SessionStore == nil {
+		return b, nil
+	}
+	s, err := h.SessionStore.Lookup(r.Context(), string(b))
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(s.ExpiresAt) {
+		return nil, ErrSessionExpired
+	}
+	return []byte(s.ProfileID), nil
+}
+
+// setCookie encrypts in along with the current time and domain, so that
+// decoding it later can detect expiry and reject cookies minted for a
+// different domain, and sets the result as an HTTP cookie named name on w.
+// It is shared by Handler and MultiHandler so both issue cookies the same
+// way. Encryption always uses keys[0]; see DecryptRotating for why keys is
+// a slice.
+func setCookie(w http.ResponseWriter, keys []*[32]byte, domain, name string, in []byte) {
+	dcheck := append([]byte(domain), byte(' ')) // delimiter
 	tb := make([]byte, len(in)+8+len(dcheck))
 
 	// Ensure user doesn't mess with the time
@@ -36,48 +75,52 @@ func (h *Handler) setCookie(w http.ResponseWriter, in []byte) {
 	// Ensure user doesn't mess with the payload
 	copy(tb[8+len(dcheck):], in)
 
-	out, err := encryptBytes(h.CookieKey, tb)
+	out, err := EncryptRotating(keys, tb)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
 	http.SetCookie(w, &http.Cookie{
-		Name:     h.cookieName(),
+		Name:     name,
 		Value:    base64.URLEncoding.EncodeToString(out),
 		Expires:  now.Add(24 * time.Hour),
 		Path:     "/", // ALL PATHS
-		Domain:   h.Domain,
+		Domain:   domain,
 		Secure:   true, // DON'T SEND UNENCRYPTED
 		HttpOnly: true, // NO CLIENT SIDE SHENANIGANS
 	})
 }
 
-func (h *Handler) Cookie(r *http.Request) ([]byte, error) {
-	c, err := r.Cookie(h.cookieName())
+// cookie reads, decrypts, and validates the HTTP cookie named name from r,
+// returning the payload passed to setCookie along with the index into keys
+// that successfully decrypted it, so callers can detect and transparently
+// upgrade cookies still encrypted with an old key.
+func cookie(r *http.Request, keys []*[32]byte, domain, name string) ([]byte, int, error) {
+	c, err := r.Cookie(name)
 	if err != nil {
-		return nil, err
+		return nil, -1, err
 	}
 	in, err := base64.URLEncoding.DecodeString(c.Value)
 	if err != nil {
-		return nil, err
+		return nil, -1, err
 	}
-	b, err := decryptBytes(h.CookieKey, in)
+	b, keyIndex, err := DecryptRotating(keys, in)
 	if err != nil {
-		return nil, err
+		return nil, -1, err
 	}
 
 	ts := binary.BigEndian.Uint64(b)
 	if time.Since(time.Unix(int64(ts), 0)) > 24*time.Hour {
-		return nil, ErrCookieExpired
+		return nil, -1, ErrCookieExpired
 	}
 	b = b[8:]
 
-	dcheck := []byte(h.Domain)
+	dcheck := []byte(domain)
 	bb := bytes.Split(b, []byte(" "))
 	if !bytes.Equal(bb[0], dcheck) {
-		return nil, ErrCookieDomain
+		return nil, -1, ErrCookieDomain
 	}
 	b = bytes.Join(bb[1:], []byte(" "))
 
-	return b, nil
+	return b, keyIndex, nil
 }
@@ -6,37 +6,42 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"golang.org/x/oauth2"
 )
 
+// Handler serves the OAuth2 flow for a single provider. Applications that
+// need to offer more than one provider (e.g. Google and GitHub side by side)
+// should use MultiHandler instead, which registers a Provider per name and
+// dispatches /login/{provider} and /oauth/{provider}/callback accordingly.
 type Handler struct {
 	// Config is the oauth2 config including client ID and client secret.
 	// Config must be set.
 	oauth2.Config
 
-	// StateKey is the key used in the OAuth2 flow to encrypt the state
+	// StateKeys are the keys used in the OAuth2 flow to encrypt the state
 	// across the redirect. A consistent State key is required across the
-	// services executing HandleLogin and the HandleRedirect. This key can
-	// be rotated freely as it is only necessary to be consistent accross a
-	// single OAuth flow. StateKey must be set.
+	// services executing HandleLogin and the HandleRedirect. Encrypting
+	// always uses StateKeys[0]; decrypting tries every key in order, so a
+	// key can be rotated by prepending a new one without breaking logins
+	// already in flight. At least one key must be set.
 	//
 	// See NewKey to generate new keys of this type and for further
 	// documentation.
-	StateKey *[32]byte
+	StateKeys []*[32]byte
 
-	// CookieKey is the key used to encrypt and decrypt cookies. A
-	// consistent Cookie key is required across the services running
-	// HandleRedirect and GetCookie. Rotating this key will log all users
-	// out (their cookies will be invalid). CookieKey must be set.
+	// CookieKeys are the keys used to encrypt and decrypt cookies.
+	// Encrypting always uses CookieKeys[0]; decrypting tries every key in
+	// order, so a key can be rotated by prepending a new one, with Cookie
+	// transparently re-issuing cookies still encrypted under an old key.
+	// The old key is only safe to remove once every cookie issued under it
+	// has passed its 24-hour lifetime. At least one key must be set.
 	//
 	// See NewKey to generate new keys of this type and for further
 	// documentation.
-	//
-	// TODO: providing an option of a slice of keys here for decryption
-	// will allow for a seamless rotation to occur across MaxAge.
-	CookieKey *[32]byte
+	CookieKeys []*[32]byte
 
 	// Domain is the fully qualified domain name that the cookies will be
 	// restricted to. Cookies from other domains will not normally be sent
@@ -66,6 +71,18 @@ type Handler struct {
 	// UserInfo must be set
 	UserInfo string
 
+	// Issuer is the OIDC issuer used to verify the id_token Google (or any
+	// other OIDC provider) returns alongside the access token, so the
+	// Profile can be decoded from it directly instead of making a second
+	// request to UserInfo. Discovery (`{issuer}/.well-known/openid-configuration`)
+	// is used to locate the provider's JWKS.
+	//
+	// e.g. "https://accounts.google.com"
+	//
+	// Issuer is optional; if empty, GetUserInfo always falls back to
+	// UserInfo.
+	Issuer string
+
 	// WriteProfile is an optional callback function to upload profile
 	// information from authenticated users to a database for use in
 	// authorization. See the Profile type for more information. Defaults
@@ -80,8 +97,39 @@ type Handler struct {
 	// the user is not allowed. By default all users are allowed.
 	ACL func(*Profile) error
 
+	// SessionStore, when set, replaces the opaque encrypted cookie with a
+	// server-side session: the cookie carries a random token that names a
+	// Session in the store instead of the Profile ID directly, so a
+	// session can be revoked (HandleLogoff, RevokeAllSessions) from the
+	// server at any time instead of just expiring after 24 hours. Defaults
+	// to nil, i.e. the cookie payload is the Profile ID.
+	SessionStore SessionStore
+
+	// RateLimiter throttles HandleLogin and HandleRedirect per remote IP.
+	// Defaults to a token bucket allowing 10/min for HandleLogin and
+	// 5/min for HandleRedirect.
+	RateLimiter RateLimiter
+
+	// TrustedProxies lists the CIDRs (or bare IPs) of reverse proxies
+	// allowed to set X-Forwarded-For. Only when the immediate RemoteAddr
+	// matches one of these is that header consulted: the right-most
+	// address in it that isn't itself a trusted proxy is used as the
+	// caller's IP for RateLimiter and AuditLogger. Otherwise RemoteAddr is
+	// used directly. Leave empty if there is no reverse proxy in front of
+	// this Handler.
+	TrustedProxies []string
+
+	// AuditLogger, when set, receives a structured AuditEvent for every
+	// login attempt, success, failure, logoff, invalid cookie, and ACL
+	// denial, for applications that need to persist this for forensic
+	// review. Defaults to discarding all events.
+	AuditLogger AuditLogger
+
 	// Log is an optional logger for debugging. Defaults to a no-op logger.
 	Log *log.Logger
+
+	rateLimiterOnce sync.Once
+	rateLimiterVal  *defaultRateLimiter
 }
 
 func (h *Handler) log() *log.Logger {
@@ -91,6 +139,13 @@ func (h *Handler) log() *log.Logger {
 	return log.New(ioutil.Discard, "", 0)
 }
 
+func (h *Handler) acl(p *Profile) error {
+	if h.ACL == nil {
+		return nil
+	}
+	return h.ACL(p)
+}
+
 func (h *Handler) finalizeLogin(w http.ResponseWriter, r *http.Request) {
 	if h.FinalizeLogin != nil {
 		h.FinalizeLogin(w, r)
@@ -99,6 +154,34 @@ func (h *Handler) finalizeLogin(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", 307)
 }
 
+func (h *Handler) rateLimiter() RateLimiter {
+	if h.RateLimiter != nil {
+		return h.RateLimiter
+	}
+	h.rateLimiterOnce.Do(func() {
+		h.rateLimiterVal = newDefaultRateLimiter()
+	})
+	return h.rateLimiterVal
+}
+
+func (h *Handler) remoteIP(r *http.Request) string {
+	return remoteIP(r, h.TrustedProxies)
+}
+
+func (h *Handler) audit(r *http.Request, eventType, profileID, reason string) {
+	if h.AuditLogger == nil {
+		return
+	}
+	h.AuditLogger.Audit(AuditEvent{
+		Type:       eventType,
+		RemoteAddr: h.remoteIP(r),
+		UserAgent:  r.UserAgent(),
+		ProfileID:  profileID,
+		Reason:     reason,
+		Time:       time.Now(),
+	})
+}
+
 // HandleLogin will redirect the user to Google's consent page to ask for
 // permission for the scopes specified in the Handler Config.
 //
@@ -106,7 +189,13 @@ func (h *Handler) finalizeLogin(w http.ResponseWriter, r *http.Request) {
 // requires authorization. For POSTS you should just fail and expect the user
 // to log on before posting.
 func (h *Handler) HandleLogin(w http.ResponseWriter, r *http.Request) {
-	_, err := h.Cookie(r)
+	if !h.rateLimiter().Allow("login:" + h.remoteIP(r)) {
+		h.audit(r, "login_failed", "", "rate limited")
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	_, err := h.Cookie(w, r)
 	if err == nil {
 		// If cookie is present and good, redirect to home as
 		// authentication is complete.
@@ -116,13 +205,16 @@ func (h *Handler) HandleLogin(w http.ResponseWriter, r *http.Request) {
 
 	if err != http.ErrNoCookie {
 		// If cookie is present but bad, delete it now.
+		h.audit(r, "cookie_invalid", "", err.Error())
 		h.HandleLogoff(w, r)
 	}
 
+	h.audit(r, "login_started", "", "")
+
 	// Now cookie is not present, procede with OAuth
 
 	origin := r.URL.String()
-	b, err := EncryptBytes(h.StateKey, []byte(origin))
+	b, err := EncryptRotating(h.StateKeys, []byte(origin))
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -132,10 +224,25 @@ func (h *Handler) HandleLogin(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, url, 307)
 }
 
-// HandleLogoff will invalidate the cookie in the user's browser.
+// HandleLogoff will invalidate the cookie in the user's browser, and, when
+// SessionStore is configured, revoke the session it names on the server so
+// the same token can't be replayed.
 func (h *Handler) HandleLogoff(w http.ResponseWriter, r *http.Request) {
+	profileID := ""
+	if b, _, err := cookie(r, h.CookieKeys, h.Domain, h.cookieName()); err == nil {
+		if h.SessionStore == nil {
+			profileID = string(b)
+		} else {
+			token := string(b)
+			if s, err := h.SessionStore.Lookup(r.Context(), token); err == nil {
+				profileID = s.ProfileID
+			}
+			h.SessionStore.Revoke(r.Context(), token)
+		}
+	}
+	h.audit(r, "logoff", profileID, "")
 	http.SetCookie(w, &http.Cookie{
-		Name:     h.CookieName,
+		Name:     h.cookieName(),
 		Value:    "",
 		Expires:  time.Unix(0, 0),
 		Path:     "/",
@@ -145,18 +252,62 @@ func (h *Handler) HandleLogoff(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// ListSessions returns every active session for profileID. It requires
+// SessionStore to be configured.
+func (h *Handler) ListSessions(ctx context.Context, profileID string) ([]*Session, error) {
+	if h.SessionStore == nil {
+		return nil, ErrNoSessionStore
+	}
+	return h.SessionStore.ListSessions(ctx, profileID)
+}
+
+// RevokeAllSessions revokes every session for profileID, e.g. to sign a
+// user out of all devices after a password reset. It requires SessionStore
+// to be configured.
+func (h *Handler) RevokeAllSessions(ctx context.Context, profileID string) error {
+	if h.SessionStore == nil {
+		return ErrNoSessionStore
+	}
+	return h.SessionStore.RevokeAll(ctx, profileID)
+}
+
+// startSession returns the bytes to use as the cookie payload for a newly
+// authenticated profileID: the raw profileID when no SessionStore is
+// configured, or an opaque session token minted from the store otherwise.
+func (h *Handler) startSession(r *http.Request, profileID string) ([]byte, error) {
+	if h.SessionStore == nil {
+		return []byte(profileID), nil
+	}
+	token, err := h.SessionStore.Create(r.Context(), Session{
+		UserAgent:  r.UserAgent(),
+		RemoteAddr: r.RemoteAddr,
+	}, profileID)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(token), nil
+}
+
 // HandleRedirect gets the redirect from Google OAuth with the authorization
 // codes, retrieves the scopes from the identity provider, issues a cookie, and
 // redirects to the original URL.
 func (h *Handler) HandleRedirect(w http.ResponseWriter, r *http.Request) {
 	// TODO: differentiate user facing errors from debug errors
+	if !h.rateLimiter().Allow("redirect:" + h.remoteIP(r)) {
+		h.audit(r, "login_failed", "", "rate limited")
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+
 	rawState, err := base64.URLEncoding.DecodeString(r.FormValue("state"))
 	if err != nil {
+		h.audit(r, "login_failed", "", "malformed state: "+err.Error())
 		http.Error(w, err.Error(), 401)
 		return
 	}
-	b, err := DecryptBytes(h.StateKey, rawState)
+	b, _, err := DecryptRotating(h.StateKeys, rawState)
 	if err != nil {
+		h.audit(r, "login_failed", "", "invalid state: "+err.Error())
 		http.Error(w, err.Error(), 401)
 		return
 	}
@@ -164,17 +315,20 @@ func (h *Handler) HandleRedirect(w http.ResponseWriter, r *http.Request) {
 
 	tok, err := h.Exchange(context.Background(), r.FormValue("code"))
 	if err != nil {
+		h.audit(r, "login_failed", "", "exchange error: "+err.Error())
 		http.Error(w, err.Error(), 401)
 		return
 	}
 
 	up, err := h.GetUserInfo(tok)
 	if err != nil {
+		h.audit(r, "login_failed", "", "userinfo error: "+err.Error())
 		http.Error(w, "userinfo request error: "+err.Error(), 500)
 		return
 	}
 
-	if err != h.acl(up) {
+	if err := h.acl(up); err != nil {
+		h.audit(r, "acl_denied", h.Service+"_"+up.Sub, err.Error())
 		http.Error(w, "ACL error: "+err.Error(), 500)
 		return
 	}
@@ -182,7 +336,14 @@ func (h *Handler) HandleRedirect(w http.ResponseWriter, r *http.Request) {
 	up.ID = h.Service + "_" + up.Sub
 	h.writeProfile(w, up)
 
-	h.SetCookie(w, []byte(up.ID))
+	cookiePayload, err := h.startSession(r, up.ID)
+	if err != nil {
+		h.audit(r, "login_failed", up.ID, "session error: "+err.Error())
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	h.SetCookie(w, cookiePayload)
+	h.audit(r, "login_succeeded", up.ID, "")
 	http.Redirect(w, r, home, 307)
 	// the user will be taken back to the page they originally tried to
 	// access. In the basic case this is whatever endpoint HandleLogin is
@@ -0,0 +1,385 @@
+package oauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+var (
+	ErrIDTokenMalformed   = errors.New("oauth: id_token is not a well-formed JWT")
+	ErrIDTokenAlg         = errors.New("oauth: id_token uses an unsupported signing algorithm")
+	ErrIDTokenKey         = errors.New("oauth: id_token signed by an unknown key")
+	ErrIDTokenSignature   = errors.New("oauth: id_token signature is invalid")
+	ErrIDTokenIssuer      = errors.New("oauth: id_token iss does not match the provider's issuer")
+	ErrIDTokenAudience    = errors.New("oauth: id_token aud does not match Config.ClientID")
+	ErrIDTokenMissingExp  = errors.New("oauth: id_token is missing the required exp claim")
+	ErrIDTokenExpired     = errors.New("oauth: id_token is expired")
+	ErrIDTokenNotYetValid = errors.New("oauth: id_token is not valid yet")
+)
+
+// idTokenClockSkewLeeway is allowed on top of exp and nbf to absorb minor
+// clock drift between this server and the provider that issued the
+// id_token, the way every mainstream JWT library does.
+const idTokenClockSkewLeeway = 1 * time.Minute
+
+// getProfile retrieves the Profile for tok. When tok carries an OIDC
+// id_token, the JWT is verified against the provider's JWKS and its claims
+// are decoded directly into a Profile, avoiding a second round-trip to
+// userInfoURL. If id_token is absent, or its claims don't include a
+// subject, GetUserInfo falls back to the UserInfo endpoint as before.
+//
+// A present but invalid id_token (bad signature, wrong issuer or audience,
+// expired) is always an error: unlike a missing id_token, it usually means
+// something is wrong with the OAuth exchange, not just that the provider
+// didn't send one.
+func getProfile(issuer, userInfoURL, clientID string, tok *oauth2.Token) (*Profile, error) {
+	raw, _ := tok.Extra("id_token").(string)
+	if raw == "" || issuer == "" {
+		return getUserInfo(userInfoURL, tok)
+	}
+
+	p, err := profileFromIDToken(issuer, clientID, raw)
+	if err != nil {
+		return nil, fmt.Errorf("id_token verification error: %w", err)
+	}
+	if p.Sub == "" {
+		// id_token didn't carry the claims we need; fall back to the
+		// UserInfo endpoint rather than returning a half-empty Profile.
+		return getUserInfo(userInfoURL, tok)
+	}
+	return p, nil
+}
+
+type idTokenClaims struct {
+	Profile
+	Iss string   `json:"iss"`
+	Aud audience `json:"aud"`
+	// Exp is a pointer so a token that omits it can be told apart from one
+	// that sets it to the zero Unix time; OIDC requires exp on every
+	// id_token, so the former must be rejected rather than treated as
+	// never-expiring.
+	Exp *int64 `json:"exp"`
+	Nbf int64  `json:"nbf"`
+}
+
+// audience unmarshals the JWT "aud" claim, which per RFC 7519 may be either
+// a single string or an array of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var ss []string
+	if err := json.Unmarshal(b, &ss); err != nil {
+		return err
+	}
+	*a = audience(ss)
+	return nil
+}
+
+func (a audience) has(v string) bool {
+	for _, s := range a {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// profileFromIDToken decodes and verifies rawIDToken, an OIDC id_token JWT,
+// against issuer's JWKS and returns the claims as a Profile. Config.ClientID
+// must appear in the token's "aud" claim, exp must be present and not
+// passed, and nbf (if present) must not be in the future, all checked
+// before any claim is trusted.
+func profileFromIDToken(issuer, clientID, rawIDToken string) (*Profile, error) {
+	parts := strings.Split(rawIDToken, ".")
+	if len(parts) != 3 {
+		return nil, ErrIDTokenMalformed
+	}
+	signedData := parts[0] + "." + parts[1]
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrIDTokenMalformed
+	}
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		return nil, ErrIDTokenMalformed
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrIDTokenMalformed
+	}
+
+	keys, err := defaultJWKSCache.get(issuer)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, header.Kid, signedData, sig, keys); err != nil {
+		return nil, err
+	}
+
+	payloadBytes, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrIDTokenMalformed
+	}
+	var claims idTokenClaims
+	if err := json.Unmarshal(payloadBytes, &claims); err != nil {
+		return nil, ErrIDTokenMalformed
+	}
+
+	if claims.Iss != issuer {
+		return nil, ErrIDTokenIssuer
+	}
+	if !claims.Aud.has(clientID) {
+		return nil, ErrIDTokenAudience
+	}
+	if claims.Exp == nil {
+		return nil, ErrIDTokenMissingExp
+	}
+	now := time.Now()
+	if now.After(time.Unix(*claims.Exp, 0).Add(idTokenClockSkewLeeway)) {
+		return nil, ErrIDTokenExpired
+	}
+	if claims.Nbf != 0 && now.Before(time.Unix(claims.Nbf, 0).Add(-idTokenClockSkewLeeway)) {
+		return nil, ErrIDTokenNotYetValid
+	}
+
+	p := claims.Profile
+	p.RawIDToken = rawIDToken
+	return &p, nil
+}
+
+// verifySignature checks sig, the JWT signature over signedData, against
+// the key named kid in keys, using the algorithm named alg. Only RS256 and
+// ES256 are supported, matching the algorithms Google, Microsoft, and every
+// other mainstream OIDC provider sign id_tokens with.
+func verifySignature(alg, kid, signedData string, sig []byte, keys jwkSet) error {
+	key, ok := keys.find(kid)
+	if !ok {
+		return ErrIDTokenKey
+	}
+
+	h := sha256.Sum256([]byte(signedData))
+
+	switch alg {
+	case "RS256":
+		pub, err := key.rsaPublicKey()
+		if err != nil {
+			return err
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, h[:], sig); err != nil {
+			return ErrIDTokenSignature
+		}
+		return nil
+	case "ES256":
+		pub, err := key.ecdsaPublicKey()
+		if err != nil {
+			return err
+		}
+		if len(sig) != 64 {
+			return ErrIDTokenSignature
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, h[:], r, s) {
+			return ErrIDTokenSignature
+		}
+		return nil
+	default:
+		return ErrIDTokenAlg
+	}
+}
+
+// jwk is a single entry of a JSON Web Key Set, as returned by a provider's
+// jwks_uri. Only the fields needed to verify RS256 and ES256 signatures are
+// kept.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) rsaPublicKey() (*rsa.PublicKey, error) {
+	if k.Kty != "RSA" {
+		return nil, ErrIDTokenKey
+	}
+	nb, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, ErrIDTokenKey
+	}
+	eb, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, ErrIDTokenKey
+	}
+	e := 0
+	for _, b := range eb {
+		e = e<<8 | int(b)
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(nb),
+		E: e,
+	}, nil
+}
+
+func (k jwk) ecdsaPublicKey() (*ecdsa.PublicKey, error) {
+	if k.Kty != "EC" || k.Crv != "P-256" {
+		return nil, ErrIDTokenKey
+	}
+	xb, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, ErrIDTokenKey
+	}
+	yb, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, ErrIDTokenKey
+	}
+	return &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(xb),
+		Y:     new(big.Int).SetBytes(yb),
+	}, nil
+}
+
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+func (s jwkSet) find(kid string) (jwk, bool) {
+	for _, k := range s.Keys {
+		if k.Kid == kid {
+			return k, true
+		}
+	}
+	return jwk{}, false
+}
+
+type oidcDiscovery struct {
+	Issuer  string `json:"issuer"`
+	JWKSURI string `json:"jwks_uri"`
+}
+
+// jwksCacheTTL bounds how long a JWKS response is cached when the provider
+// doesn't send a Cache-Control max-age, so a compromised key is never
+// trusted indefinitely even if the provider misconfigures caching.
+const jwksCacheTTL = 1 * time.Hour
+
+// jwksCache fetches and caches the JWKS for each issuer it's asked about,
+// honoring the Cache-Control max-age on the jwks_uri response so rotated
+// provider keys are picked up without every request paying for discovery.
+type jwksCache struct {
+	mu      sync.Mutex
+	entries map[string]jwksCacheEntry
+}
+
+type jwksCacheEntry struct {
+	keys    jwkSet
+	expires time.Time
+}
+
+func newJWKSCache() *jwksCache {
+	return &jwksCache{entries: make(map[string]jwksCacheEntry)}
+}
+
+var defaultJWKSCache = newJWKSCache()
+
+func (c *jwksCache) get(issuer string) (jwkSet, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[issuer]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.keys, nil
+	}
+
+	keys, ttl, err := fetchJWKS(issuer)
+	if err != nil {
+		return jwkSet{}, err
+	}
+
+	c.mu.Lock()
+	c.entries[issuer] = jwksCacheEntry{keys: keys, expires: time.Now().Add(ttl)}
+	c.mu.Unlock()
+	return keys, nil
+}
+
+func fetchJWKS(issuer string) (jwkSet, time.Duration, error) {
+	var disc oidcDiscovery
+	discURL := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	if err := getJSON(discURL, &disc); err != nil {
+		return jwkSet{}, 0, fmt.Errorf("oidc discovery error: %w", err)
+	}
+	if disc.JWKSURI == "" {
+		return jwkSet{}, 0, fmt.Errorf("oidc discovery at %s did not include a jwks_uri", discURL)
+	}
+
+	res, err := http.Get(disc.JWKSURI)
+	if err != nil {
+		return jwkSet{}, 0, fmt.Errorf("jwks fetch error: %w", err)
+	}
+	defer res.Body.Close()
+	if code := res.StatusCode; code < 200 || code > 299 {
+		return jwkSet{}, 0, fmt.Errorf("jwks fetch error: %s, status: %d", res.Status, code)
+	}
+
+	var keys jwkSet
+	if err := json.NewDecoder(res.Body).Decode(&keys); err != nil {
+		return jwkSet{}, 0, fmt.Errorf("jwks decode error: %w", err)
+	}
+
+	return keys, maxAge(res.Header.Get("Cache-Control"), jwksCacheTTL), nil
+}
+
+// maxAge parses the max-age directive out of a Cache-Control header value,
+// falling back to def if it's absent, malformed, or not positive.
+func maxAge(cacheControl string, def time.Duration) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.TrimSpace(directive)
+		if !strings.HasPrefix(directive, "max-age=") {
+			continue
+		}
+		secs, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+		if err != nil || secs <= 0 {
+			continue
+		}
+		return time.Duration(secs) * time.Second
+	}
+	return def
+}
+
+func getJSON(url string, dest interface{}) error {
+	res, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if code := res.StatusCode; code < 200 || code > 299 {
+		return fmt.Errorf("%s, status: %d", res.Status, code)
+	}
+	return json.NewDecoder(res.Body).Decode(dest)
+}
@@ -0,0 +1,198 @@
+package oauth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testClientID = "test-client-id"
+
+// idTokenTestServer serves OIDC discovery and a JWKS containing pub under
+// kid "kid1", so profileFromIDToken's issuer is just the server's URL.
+func idTokenTestServer(t *testing.T, pub *rsa.PublicKey) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	var issuer string
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:  issuer,
+			JWKSURI: issuer + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jwkSet{Keys: []jwk{rsaJWK(pub, "kid1")}})
+	})
+
+	srv := httptest.NewServer(mux)
+	issuer = srv.URL
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func rsaJWK(pub *rsa.PublicKey, kid string) jwk {
+	eb := big.NewInt(int64(pub.E)).Bytes()
+	return jwk{
+		Kty: "RSA",
+		Kid: kid,
+		N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(eb),
+	}
+}
+
+// signIDToken builds and RS256-signs a JWT carrying claims, using kid in
+// its header so verifySignature can find the matching JWKS entry.
+func signIDToken(t *testing.T, priv *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	header := map[string]interface{}{"alg": "RS256", "kid": kid}
+
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		t.Fatalf("marshal header: %v", err)
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("marshal claims: %v", err)
+	}
+
+	signedData := base64.RawURLEncoding.EncodeToString(headerJSON) + "." +
+		base64.RawURLEncoding.EncodeToString(claimsJSON)
+
+	h := sha256.Sum256([]byte(signedData))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, h[:])
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+
+	return signedData + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func baseClaims(issuer string, exp interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"iss": issuer,
+		"aud": testClientID,
+		"sub": "user-1",
+		"exp": exp,
+	}
+}
+
+func TestProfileFromIDTokenValid(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	srv := idTokenTestServer(t, &priv.PublicKey)
+
+	claims := baseClaims(srv.URL, time.Now().Add(time.Hour).Unix())
+	tok := signIDToken(t, priv, "kid1", claims)
+
+	p, err := profileFromIDToken(srv.URL, testClientID, tok)
+	if err != nil {
+		t.Fatalf("profileFromIDToken: %v", err)
+	}
+	if p.Sub != "user-1" {
+		t.Errorf("got Sub %q, want %q", p.Sub, "user-1")
+	}
+}
+
+func TestProfileFromIDTokenExpired(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	srv := idTokenTestServer(t, &priv.PublicKey)
+
+	claims := baseClaims(srv.URL, time.Now().Add(-time.Hour).Unix())
+	tok := signIDToken(t, priv, "kid1", claims)
+
+	_, err = profileFromIDToken(srv.URL, testClientID, tok)
+	if !errors.Is(err, ErrIDTokenExpired) {
+		t.Errorf("got err %v, want ErrIDTokenExpired", err)
+	}
+}
+
+func TestProfileFromIDTokenMissingExp(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	srv := idTokenTestServer(t, &priv.PublicKey)
+
+	claims := map[string]interface{}{
+		"iss": srv.URL,
+		"aud": testClientID,
+		"sub": "user-1",
+		// exp intentionally omitted: must not be treated as never-expiring.
+	}
+	tok := signIDToken(t, priv, "kid1", claims)
+
+	_, err = profileFromIDToken(srv.URL, testClientID, tok)
+	if !errors.Is(err, ErrIDTokenMissingExp) {
+		t.Errorf("got err %v, want ErrIDTokenMissingExp", err)
+	}
+}
+
+func TestProfileFromIDTokenWrongAudience(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	srv := idTokenTestServer(t, &priv.PublicKey)
+
+	claims := baseClaims(srv.URL, time.Now().Add(time.Hour).Unix())
+	claims["aud"] = "some-other-client-id"
+	tok := signIDToken(t, priv, "kid1", claims)
+
+	_, err = profileFromIDToken(srv.URL, testClientID, tok)
+	if !errors.Is(err, ErrIDTokenAudience) {
+		t.Errorf("got err %v, want ErrIDTokenAudience", err)
+	}
+}
+
+func TestProfileFromIDTokenWrongIssuer(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	srv := idTokenTestServer(t, &priv.PublicKey)
+
+	claims := baseClaims("https://not-the-issuer.example.com", time.Now().Add(time.Hour).Unix())
+	tok := signIDToken(t, priv, "kid1", claims)
+
+	_, err = profileFromIDToken(srv.URL, testClientID, tok)
+	if !errors.Is(err, ErrIDTokenIssuer) {
+		t.Errorf("got err %v, want ErrIDTokenIssuer", err)
+	}
+}
+
+func TestProfileFromIDTokenBadSignature(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	wrongPriv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	// JWKS published is priv's public key, but the token is signed with an
+	// unrelated key under the same kid.
+	srv := idTokenTestServer(t, &priv.PublicKey)
+
+	claims := baseClaims(srv.URL, time.Now().Add(time.Hour).Unix())
+	tok := signIDToken(t, wrongPriv, "kid1", claims)
+
+	_, err = profileFromIDToken(srv.URL, testClientID, tok)
+	if !errors.Is(err, ErrIDTokenSignature) {
+		t.Errorf("got err %v, want ErrIDTokenSignature", err)
+	}
+}
@@ -2,10 +2,15 @@ package oauth
 
 import (
 	"crypto/rand"
+	"errors"
 
 	"golang.org/x/crypto/nacl/secretbox"
 )
 
+// ErrNoKeys is returned by EncryptRotating and DecryptRotating when given
+// an empty key slice.
+var ErrNoKeys = errors.New("oauth: no keys configured")
+
 func NewKey() (*[32]byte, error) {
 	var k [32]byte
 	if _, err := rand.Read(k[:]); err != nil {
@@ -36,3 +41,36 @@ func DecryptBytes(key *[32]byte, b []byte) ([]byte, error) {
 	}
 	return out, nil
 }
+
+// EncryptRotating encrypts b with keys[0], the current key.
+//
+// See DecryptRotating for why keys is a slice rather than a single key.
+func EncryptRotating(keys []*[32]byte, b []byte) ([]byte, error) {
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+	return EncryptBytes(keys[0], b)
+}
+
+// DecryptRotating tries to decrypt b with each key in keys, in order,
+// returning the decrypted payload and the index of the key that worked.
+//
+// Encrypting always uses keys[0], but decrypting tries every key, so a key
+// can be rotated by prepending the new key to the slice: outstanding
+// cookies and in-flight logins keep decrypting against the old key at
+// whatever index it ends up at, while everything issued from now on uses
+// the new one. Once everything encrypted under the old key has expired
+// (cookies last 24 hours), the old key can be dropped from the slice
+// entirely.
+func DecryptRotating(keys []*[32]byte, b []byte) ([]byte, int, error) {
+	if len(keys) == 0 {
+		return nil, -1, ErrNoKeys
+	}
+	for i, key := range keys {
+		out, err := DecryptBytes(key, b)
+		if err == nil {
+			return out, i, nil
+		}
+	}
+	return nil, -1, ErrInvalidCipher
+}
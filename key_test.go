@@ -0,0 +1,127 @@
+package oauth
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func mustKey(t *testing.T) *[32]byte {
+	t.Helper()
+	k, err := NewKey()
+	if err != nil {
+		t.Fatalf("NewKey: %v", err)
+	}
+	return k
+}
+
+func TestDecryptRotatingOverlappingValidity(t *testing.T) {
+	oldKey := mustKey(t)
+	newKey := mustKey(t)
+	payload := []byte("hello")
+
+	// Encrypted before rotation, with oldKey as keys[0].
+	b, err := EncryptRotating([]*[32]byte{oldKey}, payload)
+	if err != nil {
+		t.Fatalf("EncryptRotating: %v", err)
+	}
+
+	// Rotated: newKey is now primary, but oldKey is still accepted.
+	rotated := []*[32]byte{newKey, oldKey}
+	out, keyIndex, err := DecryptRotating(rotated, b)
+	if err != nil {
+		t.Fatalf("DecryptRotating: %v", err)
+	}
+	if !bytes.Equal(out, payload) {
+		t.Errorf("got payload %q, want %q", out, payload)
+	}
+	if keyIndex != 1 {
+		t.Errorf("got keyIndex %d, want 1 (oldKey's position)", keyIndex)
+	}
+
+	// Anything newly encrypted uses the new primary key, at index 0.
+	b2, err := EncryptRotating(rotated, payload)
+	if err != nil {
+		t.Fatalf("EncryptRotating: %v", err)
+	}
+	_, keyIndex2, err := DecryptRotating(rotated, b2)
+	if err != nil {
+		t.Fatalf("DecryptRotating: %v", err)
+	}
+	if keyIndex2 != 0 {
+		t.Errorf("got keyIndex %d, want 0 (newKey's position)", keyIndex2)
+	}
+}
+
+func TestDecryptRotatingOldestKeyRemoved(t *testing.T) {
+	oldKey := mustKey(t)
+	newKey := mustKey(t)
+	payload := []byte("hello")
+
+	b, err := EncryptRotating([]*[32]byte{oldKey}, payload)
+	if err != nil {
+		t.Fatalf("EncryptRotating: %v", err)
+	}
+
+	// Once everything issued under oldKey has expired, it's dropped from
+	// the slice entirely.
+	_, _, err = DecryptRotating([]*[32]byte{newKey}, b)
+	if !errors.Is(err, ErrInvalidCipher) {
+		t.Errorf("got err %v, want ErrInvalidCipher", err)
+	}
+}
+
+func TestDecryptRotatingNoKeyDecrypts(t *testing.T) {
+	encryptKey := mustKey(t)
+	unrelatedKey := mustKey(t)
+
+	b, err := EncryptRotating([]*[32]byte{encryptKey}, []byte("hello"))
+	if err != nil {
+		t.Fatalf("EncryptRotating: %v", err)
+	}
+
+	_, keyIndex, err := DecryptRotating([]*[32]byte{unrelatedKey}, b)
+	if !errors.Is(err, ErrInvalidCipher) {
+		t.Errorf("got err %v, want ErrInvalidCipher", err)
+	}
+	if keyIndex != -1 {
+		t.Errorf("got keyIndex %d, want -1", keyIndex)
+	}
+}
+
+func TestDecryptRotatingNoKeysConfigured(t *testing.T) {
+	_, err := EncryptRotating(nil, []byte("hello"))
+	if !errors.Is(err, ErrNoKeys) {
+		t.Errorf("got err %v, want ErrNoKeys", err)
+	}
+
+	_, _, err = DecryptRotating(nil, []byte("hello"))
+	if !errors.Is(err, ErrNoKeys) {
+		t.Errorf("got err %v, want ErrNoKeys", err)
+	}
+}
+
+// TestStateKeyRotationMidFlow mirrors the StateKeys use case: a login is
+// started (state encrypted with the key that is primary at that moment),
+// StateKeys is rotated before the user completes the provider's consent
+// page, and the callback must still decrypt the in-flight state.
+func TestStateKeyRotationMidFlow(t *testing.T) {
+	before := mustKey(t)
+	origin := []byte("/dashboard")
+
+	state, err := EncryptRotating([]*[32]byte{before}, origin)
+	if err != nil {
+		t.Fatalf("EncryptRotating: %v", err)
+	}
+
+	after := mustKey(t)
+	rotated := []*[32]byte{after, before}
+
+	out, _, err := DecryptRotating(rotated, state)
+	if err != nil {
+		t.Fatalf("in-flight login broke after rotation: %v", err)
+	}
+	if !bytes.Equal(out, origin) {
+		t.Errorf("got origin %q, want %q", out, origin)
+	}
+}
@@ -0,0 +1,200 @@
+package oauth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrAccountNotFound is returned by AccountLinker.Lookup when externalID
+// isn't linked to a local user yet.
+var ErrAccountNotFound = errors.New("oauth: no account linked to this external ID")
+
+// AccountLinker merges logins from different providers into one local
+// user, so a person who signs in with Google today and GitHub tomorrow
+// ends up as the same application user instead of two. Without it,
+// MultiHandler's cookie payload is always the external ID
+// (Service_Sub); with it, a Lookup hit substitutes the local user ID.
+type AccountLinker interface {
+	// Lookup returns the local user ID linked to externalID, or
+	// ErrAccountNotFound if no link exists yet.
+	Lookup(externalID string) (localUserID string, err error)
+
+	// Link associates externalID with localUserID, so future logins with
+	// that external account resolve to localUserID.
+	Link(localUserID, externalID string) error
+
+	// Unlink removes the association created by Link.
+	Unlink(externalID string) error
+}
+
+// linkNonceMaxAge bounds how long a HandleLink redirect has to complete the
+// provider's consent flow and come back before its nonce is no longer
+// accepted.
+const linkNonceMaxAge = 10 * time.Minute
+
+// linkNonceStore tracks single-use nonces minted by HandleLink, so a given
+// link authorization can be consumed by HandleRedirect at most once. It
+// doesn't need to survive a process restart the way SessionStore does,
+// since an interrupted link attempt can just be retried from HandleLink.
+type linkNonceStore struct {
+	mu     sync.Mutex
+	expiry map[string]time.Time
+}
+
+func newLinkNonceStore() *linkNonceStore {
+	return &linkNonceStore{expiry: make(map[string]time.Time)}
+}
+
+// issue mints a fresh, unused nonce. A HandleLink call that never comes back
+// for its HandleRedirect leaves its nonce in expiry until then; issue
+// sweeps expired entries on every call so an abandoned link flow doesn't
+// leak memory for the life of the process.
+func (s *linkNonceStore) issue() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	nonce := hex.EncodeToString(b)
+
+	s.mu.Lock()
+	now := time.Now()
+	for n, exp := range s.expiry {
+		if now.After(exp) {
+			delete(s.expiry, n)
+		}
+	}
+	s.expiry[nonce] = now.Add(linkNonceMaxAge)
+	s.mu.Unlock()
+	return nonce, nil
+}
+
+// consume reports whether nonce was issued and is not yet used or expired,
+// and in doing so uses it up: a second call with the same nonce always
+// returns false. This is what makes a link authorization single-use.
+func (s *linkNonceStore) consume(nonce string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	exp, ok := s.expiry[nonce]
+	delete(s.expiry, nonce)
+	return ok && time.Now().Before(exp)
+}
+
+// resolveProfileID returns the cookie payload to issue for a newly
+// authenticated externalID on an ordinary login: the local user ID already
+// linked to externalID, if one exists, or externalID itself otherwise. It
+// never creates a new link itself — only HandleRedirect's handling of a
+// providerState minted by HandleLink does that, since that's the only path
+// that has verified who is asking for the link. See HandleLink.
+func (h *MultiHandler) resolveProfileID(externalID string) (string, error) {
+	if h.AccountLinker == nil {
+		return externalID, nil
+	}
+	localID, err := h.AccountLinker.Lookup(externalID)
+	if err == nil {
+		return localID, nil
+	}
+	if errors.Is(err, ErrAccountNotFound) {
+		return externalID, nil
+	}
+	return "", err
+}
+
+// HandleLink starts the OAuth flow for the provider named by the final path
+// segment of r (e.g. a route mounted at "/link/{provider}"), in order to
+// link that provider's external account onto the caller's existing local
+// user rather than signing them in as a new, separate user.
+//
+// The caller must already hold a valid session cookie. Unlike a plain
+// login, the resulting link is authorized by a single-use nonce minted
+// here and bound, inside the signed OAuth state, to the local user ID read
+// from that cookie right now — not by whatever cookie happens to be
+// present when the provider redirects back. Trusting the callback-time
+// cookie would let an attacker start their own OAuth flow, send the
+// resulting callback URL to a signed-in victim, and have the victim's
+// browser link the attacker's external account onto the victim's session;
+// binding the local user ID into the state at HandleLink time, before the
+// provider is ever involved, and consuming it exactly once closes that
+// hole.
+func (h *MultiHandler) HandleLink(w http.ResponseWriter, r *http.Request) {
+	if h.AccountLinker == nil {
+		http.Error(w, "account linking not configured", 404)
+		return
+	}
+
+	name := pathSuffix(r)
+	p, err := h.provider(name)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+
+	localID, err := h.Cookie(w, r)
+	if err != nil {
+		http.Error(w, "not signed in", 401)
+		return
+	}
+
+	nonce, err := h.linkNonces().issue()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	state, err := encodeProviderState(h.StateKeys, providerState{
+		Provider:    name,
+		Origin:      r.URL.String(),
+		LinkLocalID: string(localID),
+		LinkNonce:   nonce,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	http.Redirect(w, r, p.AuthCodeURL(state), 307)
+}
+
+// HandleUnlink removes the link between the caller's account and the
+// external ID given in the "external_id" form value, the inverse of the
+// linking HandleLink and HandleRedirect perform together. The caller must
+// be signed in and must already be the local user externalID is linked to;
+// it does not affect the local user account itself, only the association.
+func (h *MultiHandler) HandleUnlink(w http.ResponseWriter, r *http.Request) {
+	if h.AccountLinker == nil {
+		http.Error(w, "account linking not configured", 404)
+		return
+	}
+
+	localID, err := h.Cookie(w, r)
+	if err != nil {
+		http.Error(w, "not signed in", 401)
+		return
+	}
+
+	externalID := r.FormValue("external_id")
+	if externalID == "" {
+		http.Error(w, "external_id is required", 400)
+		return
+	}
+
+	owner, err := h.AccountLinker.Lookup(externalID)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	if owner != string(localID) {
+		http.Error(w, "forbidden", 403)
+		return
+	}
+
+	if err := h.AccountLinker.Unlink(externalID); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	h.audit(r, "account_unlinked", owner, externalID)
+	h.finalizeLogin(w, r)
+}
@@ -0,0 +1,486 @@
+package oauth
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// ErrUnknownProvider is returned when a request names a provider that was
+// not registered with MultiHandler.
+var ErrUnknownProvider = errors.New("oauth: unknown provider")
+
+// Provider holds the per-provider configuration that Handler would
+// otherwise hold on its own: the oauth2 client config, the URL to look up
+// user profile information, and the Service prefix used to namespace
+// Profile.ID for that provider.
+type Provider struct {
+	// Config is the oauth2 config including client ID and client secret
+	// for this provider. Config must be set.
+	oauth2.Config
+
+	// UserInfo is the URL with which to look up user profile information
+	// for this provider.
+	//
+	// e.g. "https://openidconnect.googleapis.com/v1/userinfo"
+	//
+	// UserInfo must be set.
+	UserInfo string
+
+	// Issuer is the OIDC issuer used to verify this provider's id_token.
+	// See Handler.Issuer for more. Issuer is optional; if empty,
+	// HandleRedirect always falls back to UserInfo for this provider.
+	Issuer string
+
+	// Service (e.g. microsoft, google, etc) is prepended to the subject ID
+	// of the oauth user for this provider. See Handler.Service for more.
+	// Service must be set.
+	Service string
+}
+
+// MultiHandler serves the OAuth2 flow for several providers at once,
+// registered by name, so an application can offer a "choose your provider"
+// login screen and mount a single set of routes for all of them. It is
+// configured like a Handler except the provider-specific fields (Config,
+// UserInfo, Service) live on the Providers registered here instead.
+type MultiHandler struct {
+	// Providers maps a short provider name (used in the /login/{provider}
+	// and /oauth/{provider}/callback routes, e.g. "google", "github") to
+	// its configuration. At least one Provider must be registered.
+	Providers map[string]*Provider
+
+	// StateKeys, CookieKeys, Domain, CookieName, WriteProfile,
+	// FinalizeLogin, ACL, SessionStore, and Log all have the same meaning
+	// as the fields of the same name on Handler, but are shared across
+	// every registered Provider.
+	StateKeys  []*[32]byte
+	CookieKeys []*[32]byte
+	Domain     string
+	CookieName string
+
+	WriteProfile  func(http.ResponseWriter, *Profile) error
+	FinalizeLogin http.HandlerFunc
+	ACL           func(*Profile) error
+	SessionStore  SessionStore
+
+	// AccountLinker, when set, merges a provider's external ID into a
+	// single local user ID shared across providers instead of leaving
+	// each provider's login as its own separate user. See AccountLinker
+	// and HandleUnlink. Defaults to nil, i.e. each provider's external ID
+	// is used as-is.
+	AccountLinker AccountLinker
+
+	// RateLimiter, TrustedProxies, and AuditLogger have the same meaning
+	// as the fields of the same name on Handler, but are shared across
+	// every registered Provider.
+	RateLimiter    RateLimiter
+	TrustedProxies []string
+	AuditLogger    AuditLogger
+
+	Log *log.Logger
+
+	rateLimiterOnce sync.Once
+	rateLimiterVal  *defaultRateLimiter
+
+	linkNonceOnce sync.Once
+	linkNonceVal  *linkNonceStore
+}
+
+// linkNonces returns the store used to issue and consume single-use
+// HandleLink nonces, lazily constructing it the same way rateLimiter does
+// for the default RateLimiter.
+func (h *MultiHandler) linkNonces() *linkNonceStore {
+	h.linkNonceOnce.Do(func() {
+		h.linkNonceVal = newLinkNonceStore()
+	})
+	return h.linkNonceVal
+}
+
+func (h *MultiHandler) log() *log.Logger {
+	if h.Log != nil {
+		return h.Log
+	}
+	return log.New(ioutil.Discard, "", 0)
+}
+
+func (h *MultiHandler) cookieName() string {
+	if h.CookieName == "" {
+		return "session"
+	}
+	return h.CookieName
+}
+
+func (h *MultiHandler) writeProfile(w http.ResponseWriter, p *Profile) error {
+	if h.WriteProfile == nil {
+		return nil
+	}
+	return h.WriteProfile(w, p)
+}
+
+func (h *MultiHandler) finalizeLogin(w http.ResponseWriter, r *http.Request) {
+	if h.FinalizeLogin != nil {
+		h.FinalizeLogin(w, r)
+		return
+	}
+	http.Redirect(w, r, "/", 307)
+}
+
+func (h *MultiHandler) acl(p *Profile) error {
+	if h.ACL == nil {
+		return nil
+	}
+	return h.ACL(p)
+}
+
+func (h *MultiHandler) rateLimiter() RateLimiter {
+	if h.RateLimiter != nil {
+		return h.RateLimiter
+	}
+	h.rateLimiterOnce.Do(func() {
+		h.rateLimiterVal = newDefaultRateLimiter()
+	})
+	return h.rateLimiterVal
+}
+
+func (h *MultiHandler) remoteIP(r *http.Request) string {
+	return remoteIP(r, h.TrustedProxies)
+}
+
+func (h *MultiHandler) audit(r *http.Request, eventType, profileID, reason string) {
+	if h.AuditLogger == nil {
+		return
+	}
+	h.AuditLogger.Audit(AuditEvent{
+		Type:       eventType,
+		RemoteAddr: h.remoteIP(r),
+		UserAgent:  r.UserAgent(),
+		ProfileID:  profileID,
+		Reason:     reason,
+		Time:       time.Now(),
+	})
+}
+
+// SetCookie issues the session cookie carrying in, the same way Handler
+// does.
+func (h *MultiHandler) SetCookie(w http.ResponseWriter, in []byte) {
+	setCookie(w, h.CookieKeys, h.Domain, h.cookieName(), in)
+}
+
+// Cookie reads and validates the session cookie, the same way Handler.Cookie
+// does, including transparently re-issuing cookies still encrypted under an
+// old CookieKeys entry.
+func (h *MultiHandler) Cookie(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	b, keyIndex, err := cookie(r, h.CookieKeys, h.Domain, h.cookieName())
+	if err != nil {
+		return nil, err
+	}
+	if keyIndex > 0 {
+		setCookie(w, h.CookieKeys, h.Domain, h.cookieName(), b)
+	}
+	if h.SessionStore == nil {
+		return b, nil
+	}
+	s, err := h.SessionStore.Lookup(r.Context(), string(b))
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(s.ExpiresAt) {
+		return nil, ErrSessionExpired
+	}
+	return []byte(s.ProfileID), nil
+}
+
+// startSession returns the bytes to use as the cookie payload for a newly
+// authenticated profileID, the same way Handler.startSession does.
+func (h *MultiHandler) startSession(r *http.Request, profileID string) ([]byte, error) {
+	if h.SessionStore == nil {
+		return []byte(profileID), nil
+	}
+	token, err := h.SessionStore.Create(r.Context(), Session{
+		UserAgent:  r.UserAgent(),
+		RemoteAddr: r.RemoteAddr,
+	}, profileID)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(token), nil
+}
+
+// provider returns the Provider registered under name, or ErrUnknownProvider
+// if none was.
+func (h *MultiHandler) provider(name string) (*Provider, error) {
+	p, ok := h.Providers[name]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+	return p, nil
+}
+
+// pathSuffix returns the final "/"-delimited segment of r.URL.Path, used to
+// pull the provider name out of routes mounted as /login/{provider} and
+// /oauth/{provider}/callback.
+func pathSuffix(r *http.Request) string {
+	p := strings.TrimSuffix(r.URL.Path, "/")
+	i := strings.LastIndex(p, "/")
+	if i < 0 {
+		return p
+	}
+	return p[i+1:]
+}
+
+// providerState is the payload encrypted into the OAuth2 state parameter. It
+// carries the provider name alongside the origin URL so HandleRedirect knows
+// which Provider's Exchange and UserInfo to use once the user comes back
+// from the identity provider, without trusting the unauthenticated "state"
+// query parameter's shape.
+//
+// LinkLocalID and LinkNonce are set only when this state was minted by
+// HandleLink rather than HandleLogin: they bind the eventual callback to
+// the local user ID that was already signed in at link time, and to a
+// single-use nonce, so HandleRedirect can tell a verified link request
+// apart from an ordinary login and never has to trust whatever cookie is
+// present when the provider redirects back. See HandleLink.
+type providerState struct {
+	Provider    string
+	Origin      string
+	LinkLocalID string
+	LinkNonce   string
+}
+
+func encodeProviderState(keys []*[32]byte, s providerState) (string, error) {
+	v := url.Values{}
+	v.Set("provider", s.Provider)
+	v.Set("origin", s.Origin)
+	if s.LinkLocalID != "" {
+		v.Set("link_local_id", s.LinkLocalID)
+		v.Set("link_nonce", s.LinkNonce)
+	}
+	b, err := EncryptRotating(keys, []byte(v.Encode()))
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(b), nil
+}
+
+func decodeProviderState(keys []*[32]byte, encoded string) (providerState, error) {
+	raw, err := base64.URLEncoding.DecodeString(encoded)
+	if err != nil {
+		return providerState{}, err
+	}
+	b, _, err := DecryptRotating(keys, raw)
+	if err != nil {
+		return providerState{}, err
+	}
+	v, err := url.ParseQuery(string(b))
+	if err != nil {
+		return providerState{}, err
+	}
+	provider := v.Get("provider")
+	if provider == "" {
+		return providerState{}, errors.New("oauth: malformed state")
+	}
+	return providerState{
+		Provider:    provider,
+		Origin:      v.Get("origin"),
+		LinkLocalID: v.Get("link_local_id"),
+		LinkNonce:   v.Get("link_nonce"),
+	}, nil
+}
+
+// HandleLogin redirects the user to the consent page of the provider named
+// by the final path segment of r (e.g. a route mounted at
+// "/login/{provider}"), asking for the scopes configured on that Provider.
+//
+// Use this when the user is not authenticated and the current GET request
+// requires authorization. For POSTS you should just fail and expect the user
+// to log on before posting.
+func (h *MultiHandler) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	name := pathSuffix(r)
+	p, err := h.provider(name)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+
+	if !h.rateLimiter().Allow("login:" + h.remoteIP(r)) {
+		h.audit(r, "login_failed", "", "rate limited")
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	_, err = h.Cookie(w, r)
+	if err == nil {
+		// If cookie is present and good, redirect to home as
+		// authentication is complete.
+		h.finalizeLogin(w, r)
+		return
+	}
+
+	if err != http.ErrNoCookie {
+		// If cookie is present but bad, delete it now.
+		h.audit(r, "cookie_invalid", "", err.Error())
+		h.HandleLogoff(w, r)
+	}
+
+	h.audit(r, "login_started", "", "")
+
+	// Now cookie is not present, procede with OAuth
+
+	state, err := encodeProviderState(h.StateKeys, providerState{
+		Provider: name,
+		Origin:   r.URL.String(),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	http.Redirect(w, r, p.AuthCodeURL(state), 307)
+}
+
+// HandleLogoff will invalidate the cookie in the user's browser, and, when
+// SessionStore is configured, revoke the session it names on the server.
+func (h *MultiHandler) HandleLogoff(w http.ResponseWriter, r *http.Request) {
+	profileID := ""
+	if b, _, err := cookie(r, h.CookieKeys, h.Domain, h.cookieName()); err == nil {
+		if h.SessionStore == nil {
+			profileID = string(b)
+		} else {
+			token := string(b)
+			if s, err := h.SessionStore.Lookup(r.Context(), token); err == nil {
+				profileID = s.ProfileID
+			}
+			h.SessionStore.Revoke(r.Context(), token)
+		}
+	}
+	h.audit(r, "logoff", profileID, "")
+	http.SetCookie(w, &http.Cookie{
+		Name:     h.cookieName(),
+		Value:    "",
+		Expires:  time.Unix(0, 0),
+		Path:     "/",
+		Domain:   h.Domain,
+		Secure:   true,
+		HttpOnly: true,
+	})
+}
+
+// HandleRedirect gets the redirect from the identity provider named in the
+// state parameter, retrieves the profile from that provider's verified
+// id_token or, failing that, its UserInfo endpoint (see getProfile), issues
+// a cookie, and redirects to the original URL.
+func (h *MultiHandler) HandleRedirect(w http.ResponseWriter, r *http.Request) {
+	// TODO: differentiate user facing errors from debug errors
+	if !h.rateLimiter().Allow("redirect:" + h.remoteIP(r)) {
+		h.audit(r, "login_failed", "", "rate limited")
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	state, err := decodeProviderState(h.StateKeys, r.FormValue("state"))
+	if err != nil {
+		h.audit(r, "login_failed", "", "invalid state: "+err.Error())
+		http.Error(w, err.Error(), 401)
+		return
+	}
+
+	p, err := h.provider(state.Provider)
+	if err != nil {
+		h.audit(r, "login_failed", "", "unknown provider: "+err.Error())
+		http.Error(w, err.Error(), 404)
+		return
+	}
+
+	tok, err := p.Exchange(context.Background(), r.FormValue("code"))
+	if err != nil {
+		h.audit(r, "login_failed", "", "exchange error: "+err.Error())
+		http.Error(w, err.Error(), 401)
+		return
+	}
+
+	up, err := getProfile(p.Issuer, p.UserInfo, p.ClientID, tok)
+	if err != nil {
+		h.audit(r, "login_failed", "", "userinfo error: "+err.Error())
+		http.Error(w, "userinfo request error: "+err.Error(), 500)
+		return
+	}
+
+	if err := h.acl(up); err != nil {
+		h.audit(r, "acl_denied", p.Service+"_"+up.Sub, err.Error())
+		http.Error(w, "ACL error: "+err.Error(), 500)
+		return
+	}
+
+	externalID := p.Service + "_" + up.Sub
+	if state.LinkLocalID != "" {
+		if h.AccountLinker == nil {
+			h.audit(r, "login_failed", externalID, "account linking not configured")
+			http.Error(w, "account linking not configured", 404)
+			return
+		}
+		// A HandleLink redirect: the nonce proves this callback belongs to
+		// the same local user who started it, not just whoever currently
+		// holds a cookie, so it's safe to create the link.
+		if !h.linkNonces().consume(state.LinkNonce) {
+			h.audit(r, "login_failed", externalID, "invalid or reused link nonce")
+			http.Error(w, "invalid or expired link request", 401)
+			return
+		}
+		if err := h.AccountLinker.Link(state.LinkLocalID, externalID); err != nil {
+			h.audit(r, "login_failed", externalID, "account link error: "+err.Error())
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		h.audit(r, "account_linked", state.LinkLocalID, externalID)
+		up.ID = state.LinkLocalID
+	} else {
+		up.ID, err = h.resolveProfileID(externalID)
+		if err != nil {
+			h.audit(r, "login_failed", externalID, "account link error: "+err.Error())
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+	h.writeProfile(w, up)
+
+	cookiePayload, err := h.startSession(r, up.ID)
+	if err != nil {
+		h.audit(r, "login_failed", up.ID, "session error: "+err.Error())
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	h.SetCookie(w, cookiePayload)
+	h.audit(r, "login_succeeded", up.ID, "")
+	http.Redirect(w, r, state.Origin, 307)
+	// the user will be taken back to the page they originally tried to
+	// access. In the basic case this is whatever endpoint HandleLogin is
+	// serving for.
+}
+
+// ListSessions returns every active session for profileID. It requires
+// SessionStore to be configured.
+func (h *MultiHandler) ListSessions(ctx context.Context, profileID string) ([]*Session, error) {
+	if h.SessionStore == nil {
+		return nil, ErrNoSessionStore
+	}
+	return h.SessionStore.ListSessions(ctx, profileID)
+}
+
+// RevokeAllSessions revokes every session for profileID, e.g. to sign a
+// user out of all devices after a password reset. It requires SessionStore
+// to be configured.
+func (h *MultiHandler) RevokeAllSessions(ctx context.Context, profileID string) error {
+	if h.SessionStore == nil {
+		return ErrNoSessionStore
+	}
+	return h.SessionStore.RevokeAll(ctx, profileID)
+}
@@ -0,0 +1,175 @@
+package oauth
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimiter decides whether to allow a request identified by key, so
+// Handler can throttle HandleLogin and HandleRedirect without baking in a
+// specific algorithm. HandleLogin and HandleRedirect call Allow with keys
+// prefixed "login:" and "redirect:" respectively, followed by the caller's
+// remote IP (see TrustedProxies), so a custom RateLimiter can apply
+// different limits per endpoint if it wants to.
+type RateLimiter interface {
+	Allow(key string) bool
+}
+
+// endpointRatePerMinute gives the default requests-per-minute allowed per
+// IP for each endpoint prefix defaultRateLimiter recognizes.
+var endpointRatePerMinute = map[string]float64{
+	"login":    10,
+	"redirect": 5,
+}
+
+// defaultRateLimiterFallbackRate is used for any key whose prefix isn't in
+// endpointRatePerMinute, which shouldn't happen from Handler itself but
+// keeps defaultRateLimiter safe to reuse for other keys.
+const defaultRateLimiterFallbackRate = 10
+
+// bucketIdleTTL is how long a key's bucket can go untouched before Allow
+// evicts it. A bucket that's been idle this long would have refilled to
+// its full burst anyway, so recreating it from scratch on the next request
+// is indistinguishable to the caller; this is what keeps buckets from
+// growing without bound when an attacker cycles source IPs.
+const bucketIdleTTL = time.Hour
+
+// defaultRateLimiter is a per-key token bucket refilled continuously at
+// the key's endpoint rate, with a burst equal to one minute's worth of
+// requests.
+type defaultRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+func newDefaultRateLimiter() *defaultRateLimiter {
+	return &defaultRateLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+func (l *defaultRateLimiter) Allow(key string) bool {
+	perMinute := float64(defaultRateLimiterFallbackRate)
+	if i := strings.IndexByte(key, ':'); i >= 0 {
+		if r, ok := endpointRatePerMinute[key[:i]]; ok {
+			perMinute = r
+		}
+	}
+	ratePerSecond := perMinute / 60
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for k, bucket := range l.buckets {
+		if k != key && now.Sub(bucket.lastRefill) > bucketIdleTTL {
+			delete(l.buckets, k)
+		}
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: perMinute - 1, lastRefill: now}
+		l.buckets[key] = b
+		return true
+	}
+
+	b.tokens += now.Sub(b.lastRefill).Seconds() * ratePerSecond
+	if b.tokens > perMinute {
+		b.tokens = perMinute
+	}
+	b.lastRefill = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// remoteIP returns the caller's IP for r: RemoteAddr by default, or the
+// right-most address in X-Forwarded-For that isn't itself one of
+// trustedProxies, when RemoteAddr's IP matches one of trustedProxies and
+// the header is present. Each hop in the chain appends to the right of
+// X-Forwarded-For, so the left-most entry is whatever the original client
+// sent and is fully attacker-controlled; walking from the right and
+// skipping our own trusted proxies finds the first hop we didn't add
+// ourselves, i.e. the real client. Trusting X-Forwarded-For from an
+// untrusted RemoteAddr at all would let a client spoof its rate-limit key
+// and audit trail, so it's only honored from a configured reverse proxy.
+func remoteIP(r *http.Request, trustedProxies []string) string {
+	host := r.RemoteAddr
+	if h, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		host = h
+	}
+
+	if len(trustedProxies) == 0 {
+		return host
+	}
+	if !ipInCIDRs(host, trustedProxies) {
+		return host
+	}
+
+	xff := r.Header.Get("X-Forwarded-For")
+	if xff == "" {
+		return host
+	}
+	hops := strings.Split(xff, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if ipInCIDRs(hop, trustedProxies) {
+			// Another one of our proxies; keep walking left past it.
+			continue
+		}
+		return hop
+	}
+	return host
+}
+
+// ipInCIDRs reports whether ip falls within any of cidrs. Entries may be a
+// CIDR range or a bare IP, which is treated as a /32 (or /128 for IPv6);
+// rejecting bare IPs here would silently disable TrustedProxies for the
+// common case of pointing it at a single reverse proxy.
+func ipInCIDRs(ip string, cidrs []string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, cidr := range cidrs {
+		network := parseTrustedProxy(cidr)
+		if network == nil {
+			continue
+		}
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxy parses a TrustedProxies entry as a CIDR range, falling
+// back to treating it as a single bare IP address. It returns nil if s is
+// neither.
+func parseTrustedProxy(s string) *net.IPNet {
+	if _, network, err := net.ParseCIDR(s); err == nil {
+		return network
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+	bits := 32
+	if ip.To4() == nil {
+		bits = 128
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
@@ -0,0 +1,153 @@
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrSessionNotFound is returned by SessionStore.Lookup when token
+	// doesn't name a known session (including one that was revoked).
+	ErrSessionNotFound = errors.New("oauth: session not found")
+
+	// ErrSessionExpired is returned by Handler.Cookie when the session a
+	// cookie points at has passed its ExpiresAt.
+	ErrSessionExpired = errors.New("oauth: session expired")
+
+	// ErrNoSessionStore is returned by the Handler session admin methods
+	// when SessionStore is not configured.
+	ErrNoSessionStore = errors.New("oauth: no SessionStore configured")
+)
+
+// sessionMaxAge is how long a session is valid for from issuance, used when
+// a Handler has a SessionStore but no cookie has been set yet.
+const sessionMaxAge = 24 * time.Hour
+
+// Session is a single signed-in session, as tracked by a SessionStore. It
+// carries enough to answer "who is this" (ProfileID) and "should we be
+// suspicious of this" (UserAgent, RemoteAddr) for an admin-facing sessions
+// list.
+type Session struct {
+	Token      string
+	ProfileID  string
+	IssuedAt   time.Time
+	ExpiresAt  time.Time
+	UserAgent  string
+	RemoteAddr string
+}
+
+// SessionStore tracks server-side sessions so applications can revoke a
+// single session, revoke every session for a user (e.g. after a password
+// reset), and list who is currently signed in. When a Handler's
+// SessionStore is set, the cookie value is an opaque token that names a
+// Session in the store rather than the Profile ID directly.
+type SessionStore interface {
+	// Create mints a new session for profileID, persists it, and returns
+	// its opaque token. s.ProfileID is ignored; s.IssuedAt and s.Token are
+	// set by the store.
+	Create(ctx context.Context, s Session, profileID string) (token string, err error)
+
+	// Lookup returns the session named by token, or ErrSessionNotFound if
+	// it doesn't exist or was revoked.
+	Lookup(ctx context.Context, token string) (*Session, error)
+
+	// Revoke invalidates a single session. It is a no-op if token is
+	// already unknown.
+	Revoke(ctx context.Context, token string) error
+
+	// RevokeAll invalidates every session belonging to profileID, e.g.
+	// after a password reset or a "sign out everywhere" request.
+	RevokeAll(ctx context.Context, profileID string) error
+
+	// ListSessions returns every non-expired session belonging to
+	// profileID, for an admin-facing "where am I signed in" view.
+	ListSessions(ctx context.Context, profileID string) ([]*Session, error)
+}
+
+// newSessionToken returns a random, URL-safe session token with enough
+// entropy (16 bytes) that it cannot feasibly be guessed or brute-forced.
+func newSessionToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// MemorySessionStore is an in-memory SessionStore. Sessions do not survive
+// a process restart; use BoltSessionStore for a durable store.
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*Session // token -> session
+}
+
+// NewMemorySessionStore returns an empty MemorySessionStore ready to use.
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: make(map[string]*Session)}
+}
+
+func (m *MemorySessionStore) Create(ctx context.Context, s Session, profileID string) (string, error) {
+	token, err := newSessionToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	s.Token = token
+	s.ProfileID = profileID
+	s.IssuedAt = now
+	if s.ExpiresAt.IsZero() {
+		s.ExpiresAt = now.Add(sessionMaxAge)
+	}
+
+	m.mu.Lock()
+	m.sessions[token] = &s
+	m.mu.Unlock()
+	return token, nil
+}
+
+func (m *MemorySessionStore) Lookup(ctx context.Context, token string) (*Session, error) {
+	m.mu.Lock()
+	s, ok := m.sessions[token]
+	m.mu.Unlock()
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	cp := *s
+	return &cp, nil
+}
+
+func (m *MemorySessionStore) Revoke(ctx context.Context, token string) error {
+	m.mu.Lock()
+	delete(m.sessions, token)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemorySessionStore) RevokeAll(ctx context.Context, profileID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for token, s := range m.sessions {
+		if s.ProfileID == profileID {
+			delete(m.sessions, token)
+		}
+	}
+	return nil
+}
+
+func (m *MemorySessionStore) ListSessions(ctx context.Context, profileID string) ([]*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	var out []*Session
+	for _, s := range m.sessions {
+		if s.ProfileID == profileID && now.Before(s.ExpiresAt) {
+			cp := *s
+			out = append(out, &cp)
+		}
+	}
+	return out, nil
+}
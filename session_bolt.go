@@ -0,0 +1,144 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+var sessionsBucket = []byte("sessions")
+
+// BoltSessionStore is a SessionStore backed by a bbolt database, for
+// applications that need sessions to survive a restart without standing up
+// a separate datastore. Sessions are JSON-encoded values in a single
+// bucket keyed by token; RevokeAll and ListSessions scan the bucket for
+// matching ProfileID, which is fine at the session counts a single bbolt
+// file is meant for.
+type BoltSessionStore struct {
+	db *bbolt.DB
+}
+
+// NewBoltSessionStore opens (creating if necessary) a bbolt database at
+// path and returns a SessionStore backed by it. Callers are responsible
+// for closing the returned store's underlying DB via Close.
+func NewBoltSessionStore(path string) (*BoltSessionStore, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(sessionsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltSessionStore{db: db}, nil
+}
+
+// Close closes the underlying bbolt database.
+func (b *BoltSessionStore) Close() error {
+	return b.db.Close()
+}
+
+func (b *BoltSessionStore) Create(ctx context.Context, s Session, profileID string) (string, error) {
+	token, err := newSessionToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	s.Token = token
+	s.ProfileID = profileID
+	s.IssuedAt = now
+	if s.ExpiresAt.IsZero() {
+		s.ExpiresAt = now.Add(sessionMaxAge)
+	}
+
+	v, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	err = b.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(sessionsBucket).Put([]byte(token), v)
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (b *BoltSessionStore) Lookup(ctx context.Context, token string) (*Session, error) {
+	var s Session
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(sessionsBucket).Get([]byte(token))
+		if v == nil {
+			return ErrSessionNotFound
+		}
+		return json.Unmarshal(v, &s)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (b *BoltSessionStore) Revoke(ctx context.Context, token string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(sessionsBucket).Delete([]byte(token))
+	})
+}
+
+func (b *BoltSessionStore) RevokeAll(ctx context.Context, profileID string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bkt := tx.Bucket(sessionsBucket)
+
+		// bbolt documents ForEach as undefined behavior if the bucket is
+		// modified during the scan, so collect the matching keys first and
+		// delete them in a second pass once the scan is done.
+		var keys [][]byte
+		err := bkt.ForEach(func(k, v []byte) error {
+			var s Session
+			if err := json.Unmarshal(v, &s); err != nil {
+				return err
+			}
+			if s.ProfileID == profileID {
+				keys = append(keys, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			if err := bkt.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltSessionStore) ListSessions(ctx context.Context, profileID string) ([]*Session, error) {
+	var out []*Session
+	now := time.Now()
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(sessionsBucket).ForEach(func(k, v []byte) error {
+			var s Session
+			if err := json.Unmarshal(v, &s); err != nil {
+				return err
+			}
+			if s.ProfileID == profileID && now.Before(s.ExpiresAt) {
+				out = append(out, &s)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
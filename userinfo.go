@@ -16,7 +16,9 @@ func (h *Handler) writeProfile(w http.ResponseWriter, p *Profile) error {
 }
 
 type Profile struct {
-	ID            string `json:"-"`
+	ID         string `json:"-"`
+	RawIDToken string `json:"-"`
+
 	Sub           string `json:"sub"`
 	Name          string `json:"name"`
 	GivenName     string `json:"given_name"`
@@ -29,9 +31,21 @@ type Profile struct {
 	Locale        string `json:"locale"`
 }
 
+// GetUserInfo retrieves the Profile for tok. If tok carries an id_token (as
+// Google and every other OIDC provider include alongside the access token),
+// its claims are verified against h.Issuer's JWKS and decoded directly,
+// skipping the round-trip to h.UserInfo. See getProfile for the fallback
+// rules.
 func (h *Handler) GetUserInfo(tok *oauth2.Token) (*Profile, error) {
+	return getProfile(h.Issuer, h.UserInfo, h.ClientID, tok)
+}
+
+// getUserInfo looks up the profile for tok at userInfoURL. It is shared by
+// Handler, which has a single fixed UserInfo URL, and MultiHandler, which
+// looks up the URL for the provider named in the request.
+func getUserInfo(userInfoURL string, tok *oauth2.Token) (*Profile, error) {
 	// TODO: populate this URL from the Directory URL
-	req, err := http.NewRequest("GET", h.UserInfo, nil)
+	req, err := http.NewRequest("GET", userInfoURL, nil)
 	if err != nil {
 		return nil, err
 	}